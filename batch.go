@@ -0,0 +1,219 @@
+package gocollectanalytics
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxBatchHits and maxHitSize mirror the limits GA documents for its
+// /batch endpoint: at most 20 hits per batch, each at most 16KB.
+const (
+	maxBatchHits = 20
+	maxHitSize   = 16 * 1024
+)
+
+// An Enricher augments a decoded Hit with additional context derived from
+// the HTTP request that delivered it - GeoIP location, User-Agent parsing,
+// locale, referrer, or anything else a caller wants to plug in (ASN lookup,
+// bot filtering, ...). CollectData and CollectBatch run every Enricher
+// registered on the Collector, in order, before a hit is recorded. An
+// Enricher should treat the Hit's existing fields as already-trustworthy
+// and only fill in what it owns; a failing Enricher logs its error but does
+// not stop the hit from being recorded.
+type Enricher interface {
+	Enrich(ctx context.Context, hit *Hit, r *http.Request) error
+}
+
+// EnricherFunc adapts a plain function to the Enricher interface.
+type EnricherFunc func(ctx context.Context, hit *Hit, r *http.Request) error
+
+// Enrich calls f.
+func (f EnricherFunc) Enrich(ctx context.Context, hit *Hit, r *http.Request) error {
+	return f(ctx, hit, r)
+}
+
+// A BatchDatastore is a Datastore that can additionally record many hits in
+// a single transaction. The Collector's dispatcher uses LogBatch for every
+// batch a worker flushes when the configured Datastore implements it,
+// falling back to one LogIt call per hit otherwise.
+type BatchDatastore interface {
+	Datastore
+	LogBatch([]interface{}) error
+}
+
+// CollectBatch is a http.HandlerFunc implementing GA's /batch endpoint. The
+// request body is newline-separated Measurement Protocol payloads, in the
+// same syntax CollectData accepts as a query string; each line is decoded,
+// validated and enriched independently, and each resulting hit is queued to
+// the dispatcher on its own. The hits of one request are therefore not
+// recorded as one transaction: different workers may flush them in
+// separate LogIt or LogBatch calls.
+func (coll *Collector) CollectBatch(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchHits*maxHitSize)
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, maxHitSize), maxHitSize)
+
+	hits := make([]interface{}, 0, maxBatchHits)
+	lines := 0
+	for scanner.Scan() {
+		lines++
+		if lines > maxBatchHits {
+			log.Printf("batch exceeds the maximum of %d hits, discarding the remainder", maxBatchHits)
+			break
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		vals, err := url.ParseQuery(line)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		hit, err := coll.decodeHit(vals, r)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		hits = append(hits, hit)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	for _, hit := range hits {
+		coll.dispatch.enqueue(hit)
+		coll.stream.publish(hit.(*Hit))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// RefererEnricher splits the request's Referer header into the host and
+// path that drove the hit.
+type RefererEnricher struct{}
+
+// Enrich implements Enricher.
+func (RefererEnricher) Enrich(ctx context.Context, hit *Hit, r *http.Request) error {
+	ref := r.Referer()
+	if ref == "" {
+		return nil
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil
+	}
+	hit.ReferrerHost = u.Host
+	hit.ReferrerPath = u.Path
+	return nil
+}
+
+// AcceptLanguageEnricher populates Hit.Locale from the request's
+// Accept-Language header, taking the first language listed; q-values are
+// not consulted.
+type AcceptLanguageEnricher struct{}
+
+// Enrich implements Enricher.
+func (AcceptLanguageEnricher) Enrich(ctx context.Context, hit *Hit, r *http.Request) error {
+	al := r.Header.Get("Accept-Language")
+	if al == "" {
+		return nil
+	}
+	first := strings.Split(al, ",")[0]
+	hit.Locale = strings.TrimSpace(strings.Split(first, ";")[0])
+	return nil
+}
+
+// UserAgentEnricher does a lightweight, dependency-free parse of the
+// request's User-Agent header into a coarse device type, OS and browser.
+// It favours cheap, common-case heuristics over exhaustive accuracy; swap
+// in an Enricher backed by a full UA database where that matters.
+type UserAgentEnricher struct{}
+
+// Enrich implements Enricher.
+func (UserAgentEnricher) Enrich(ctx context.Context, hit *Hit, r *http.Request) error {
+	hit.DeviceType, hit.OS, hit.Browser = parseUserAgent(r.UserAgent())
+	return nil
+}
+
+func parseUserAgent(ua string) (device, os, browser string) {
+	switch {
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"):
+		device, os = "mobile", "iOS"
+	case strings.Contains(ua, "Android"):
+		device, os = "mobile", "Android"
+	case strings.Contains(ua, "Windows"):
+		device, os = "desktop", "Windows"
+	case strings.Contains(ua, "Macintosh"):
+		device, os = "desktop", "macOS"
+	case strings.Contains(ua, "Linux"):
+		device, os = "desktop", "Linux"
+	}
+	if device == "" {
+		device = "desktop"
+	}
+
+	switch {
+	case strings.Contains(ua, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "Safari/") && !strings.Contains(ua, "Chrome"):
+		browser = "Safari"
+	}
+
+	return device, os, browser
+}
+
+// A GeoIPLookup resolves a client IP to a coarse geographic location. It is
+// satisfied by, for example, a wrapper around a MaxMind mmdb reader; this
+// package does not depend on any particular GeoIP database format or
+// vendor.
+//
+// This package intentionally ships no built-in GeoIPLookup: a MaxMind (or
+// any other provider's) database reader is an external dependency with its
+// own update cadence and licensing, both of which belong to the caller's
+// deployment, not to this package. Construct GeoIPEnricher with a
+// GeoIPLookup backed by whichever GeoIP provider and database your
+// deployment already manages.
+type GeoIPLookup interface {
+	Lookup(ip net.IP) (country, city string, err error)
+}
+
+// GeoIPEnricher populates Hit.Country and Hit.City from the request's
+// remote address, using the supplied GeoIPLookup. See GeoIPLookup's doc
+// comment: this package ships no concrete implementation, only the hook.
+type GeoIPEnricher struct {
+	Lookup GeoIPLookup
+}
+
+// Enrich implements Enricher.
+func (g GeoIPEnricher) Enrich(ctx context.Context, hit *Hit, r *http.Request) error {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+
+	country, city, err := g.Lookup.Lookup(ip)
+	if err != nil {
+		return err
+	}
+	hit.Country = country
+	hit.City = city
+	return nil
+}
@@ -0,0 +1,97 @@
+package gocollectanalytics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingStore is a Datastore that records every hit it's given, for
+// tests to inspect.
+type recordingStore struct {
+	mu   sync.Mutex
+	hits []interface{}
+}
+
+func (s *recordingStore) LogIt(hit interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hits = append(s.hits, hit)
+	return nil
+}
+
+func (s *recordingStore) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.hits)
+}
+
+const validEventLine = "v=1&tid=UA-12345-1&t=event&ec=video&ea=play"
+
+func TestCollectBatchBoundsLineCount(t *testing.T) {
+	store := &recordingStore{}
+	coll := NewCollector(store, CollectorConfig{FlushInterval: 10 * time.Millisecond})
+
+	var body strings.Builder
+	for i := 0; i < maxBatchHits+5; i++ {
+		body.WriteString("\n")
+	}
+	body.WriteString(validEventLine + "\n")
+
+	req := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(body.String()))
+	w := httptest.NewRecorder()
+	coll.CollectBatch(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("CollectBatch status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	if err := coll.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if n := store.count(); n != 0 {
+		t.Fatalf("store recorded %d hits, want 0: the trailing valid line is past the %d line cap", n, maxBatchHits)
+	}
+}
+
+func TestCollectBatchBoundsBodySize(t *testing.T) {
+	store := &recordingStore{}
+	coll := NewCollector(store, CollectorConfig{FlushInterval: 10 * time.Millisecond})
+
+	oversized := strings.Repeat("a", maxBatchHits*maxHitSize+1)
+	req := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(oversized))
+	w := httptest.NewRecorder()
+	coll.CollectBatch(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("CollectBatch status = %d, want %d for an oversized body", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestCollectBatchRecordsValidHitsWithinLimit(t *testing.T) {
+	store := &recordingStore{}
+	coll := NewCollector(store, CollectorConfig{FlushInterval: 10 * time.Millisecond})
+
+	var body strings.Builder
+	for i := 0; i < 3; i++ {
+		body.WriteString(validEventLine + "\n")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(body.String()))
+	w := httptest.NewRecorder()
+	coll.CollectBatch(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("CollectBatch status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if err := coll.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if n := store.count(); n != 3 {
+		t.Fatalf("store recorded %d hits, want 3", n)
+	}
+}
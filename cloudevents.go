@@ -0,0 +1,167 @@
+package gocollectanalytics
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// CloudEventsMode selects how a CloudEventsDatastore puts its envelope onto
+// the wire.
+type CloudEventsMode int
+
+const (
+	// CloudEventsStructured hands the underlying Datastore's LogIt/LogBatch
+	// the envelope itself, a value that encoding/json marshals to a single
+	// JSON document with the data included.
+	CloudEventsStructured CloudEventsMode = iota
+	// CloudEventsBinary serializes the hit's JSON as the event body and
+	// the rest of the envelope as ce-* headers, via CloudEventBinary, for
+	// a Datastore that posts to an HTTP sink.
+	CloudEventsBinary
+)
+
+const cloudEventsSpecVersion = "1.0"
+
+// cloudEvent is a CNCF CloudEvents 1.0 envelope around one Hit.
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// CloudEventBinary is the binary-mode encoding of a CloudEvents envelope:
+// the event data as the body, and the envelope's metadata as the ce-*
+// headers a CloudEvents-compatible HTTP sink (Knative, a Tekton
+// EventListener, a generic webhook, ...) expects.
+type CloudEventBinary struct {
+	Headers map[string]string
+	Body    []byte
+}
+
+// CloudEventsDatastore wraps another Datastore, serializing each hit as a
+// CloudEvents 1.0 envelope before handing it to the wrapped store's LogIt
+// or LogBatch. source is the hit's tid, type is
+// "io.gocollectanalytics.hit.<hittype>", and data is the hit itself.
+type CloudEventsDatastore struct {
+	Datastore
+	Mode CloudEventsMode
+}
+
+// NewCloudEventsDatastore wraps ds so every hit recorded through it is
+// first serialized as a CloudEvents envelope, in the given Mode.
+func NewCloudEventsDatastore(ds Datastore, mode CloudEventsMode) *CloudEventsDatastore {
+	return &CloudEventsDatastore{Datastore: ds, Mode: mode}
+}
+
+// LogIt implements Datastore, recording v's envelope instead of v
+// itself. A hit that fails to build an envelope - e.g. because it won't
+// marshal to JSON - will fail the same way on every attempt, so that error
+// is reported as a PermanentError rather than one worth retrying.
+func (ce *CloudEventsDatastore) LogIt(v interface{}) error {
+	env, err := ce.envelope(v)
+	if err != nil {
+		return NewPermanentError(err)
+	}
+	return ce.Datastore.LogIt(env)
+}
+
+// LogBatch implements BatchDatastore, wrapping every hit in vs before
+// passing them on to the underlying store's LogBatch when it supports
+// batching, or one LogIt call at a time otherwise.
+func (ce *CloudEventsDatastore) LogBatch(vs []interface{}) error {
+	envs := make([]interface{}, len(vs))
+	for i, v := range vs {
+		env, err := ce.envelope(v)
+		if err != nil {
+			return NewPermanentError(err)
+		}
+		envs[i] = env
+	}
+
+	if bds, ok := ce.Datastore.(BatchDatastore); ok {
+		return bds.LogBatch(envs)
+	}
+	for _, env := range envs {
+		if err := ce.Datastore.LogIt(env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// envelope builds the CloudEvents envelope for v, in the form ce.Mode
+// calls for: the cloudEvent struct itself in structured mode, or a
+// CloudEventBinary in binary mode.
+func (ce *CloudEventsDatastore) envelope(v interface{}) (interface{}, error) {
+	hit, ok := v.(*Hit)
+	if !ok {
+		return nil, fmt.Errorf("cloudevents: expected *Hit, got %T", v)
+	}
+
+	data, err := json.Marshal(hit)
+	if err != nil {
+		return nil, err
+	}
+
+	env := cloudEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              newEventID(),
+		Source:          siteID(hit),
+		Type:            "io.gocollectanalytics.hit." + hit.HitName(),
+		Time:            hit.ReceivedAt,
+		DataContentType: "application/json",
+		Data:            data,
+	}
+
+	if ce.Mode == CloudEventsBinary {
+		return env.toBinary(), nil
+	}
+	return env, nil
+}
+
+// toBinary renders e in CloudEvents binary mode: the data as the body, the
+// rest of the envelope as ce-* headers.
+func (e cloudEvent) toBinary() CloudEventBinary {
+	return CloudEventBinary{
+		Headers: map[string]string{
+			"ce-specversion": e.SpecVersion,
+			"ce-id":          e.ID,
+			"ce-source":      e.Source,
+			"ce-type":        e.Type,
+			"ce-time":        e.Time.Format(time.RFC3339Nano),
+			"Content-Type":   e.DataContentType,
+		},
+		Body: []byte(e.Data),
+	}
+}
+
+// siteIdentifiable is satisfied by any HitType that can report the tid it
+// belongs to; every built-in hit type does, via its embedded Common.
+type siteIdentifiable interface {
+	SiteID() string
+}
+
+// siteID returns hit's tid, or "" if its HitType doesn't expose one.
+func siteID(hit *Hit) string {
+	if s, ok := hit.HitType.(siteIdentifiable); ok {
+		return s.SiteID()
+	}
+	return ""
+}
+
+// newEventID generates a random UUID (v4) for use as a CloudEvents id.
+func newEventID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,121 @@
+package gocollectanalytics
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func testHit() *Hit {
+	return &Hit{
+		HitType: Event{
+			Common:   Common{Site: "UA-12345-1"},
+			Category: "video",
+			Action:   "play",
+		},
+		ReceivedAt: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func TestCloudEventsDatastoreLogItStructured(t *testing.T) {
+	store := &recordingStore{}
+	ce := NewCloudEventsDatastore(store, CloudEventsStructured)
+
+	if err := ce.LogIt(testHit()); err != nil {
+		t.Fatalf("LogIt: %v", err)
+	}
+	if got := store.count(); got != 1 {
+		t.Fatalf("store recorded %d envelopes, want 1", got)
+	}
+
+	env, ok := store.hits[0].(cloudEvent)
+	if !ok {
+		t.Fatalf("store recorded %T, want cloudEvent", store.hits[0])
+	}
+	if env.SpecVersion != cloudEventsSpecVersion {
+		t.Fatalf("SpecVersion = %q, want %q", env.SpecVersion, cloudEventsSpecVersion)
+	}
+	if env.Source != "UA-12345-1" {
+		t.Fatalf("Source = %q, want %q", env.Source, "UA-12345-1")
+	}
+	if env.Type != "io.gocollectanalytics.hit.event" {
+		t.Fatalf("Type = %q, want %q", env.Type, "io.gocollectanalytics.hit.event")
+	}
+	if env.ID == "" {
+		t.Fatal("ID is empty")
+	}
+
+	var data struct {
+		Hit struct {
+			Category string `json:"category"`
+		} `json:"hit"`
+	}
+	if err := json.Unmarshal(env.Data, &data); err != nil {
+		t.Fatalf("unmarshal envelope data: %v", err)
+	}
+	if data.Hit.Category != "video" {
+		t.Fatalf("envelope data category = %q, want %q", data.Hit.Category, "video")
+	}
+}
+
+func TestCloudEventsDatastoreLogItBinary(t *testing.T) {
+	store := &recordingStore{}
+	ce := NewCloudEventsDatastore(store, CloudEventsBinary)
+
+	if err := ce.LogIt(testHit()); err != nil {
+		t.Fatalf("LogIt: %v", err)
+	}
+
+	bin, ok := store.hits[0].(CloudEventBinary)
+	if !ok {
+		t.Fatalf("store recorded %T, want CloudEventBinary", store.hits[0])
+	}
+	if bin.Headers["ce-type"] != "io.gocollectanalytics.hit.event" {
+		t.Fatalf("ce-type header = %q, want %q", bin.Headers["ce-type"], "io.gocollectanalytics.hit.event")
+	}
+	if bin.Headers["Content-Type"] != "application/json" {
+		t.Fatalf("Content-Type header = %q, want application/json", bin.Headers["Content-Type"])
+	}
+	if len(bin.Body) == 0 {
+		t.Fatal("binary body is empty")
+	}
+}
+
+func TestCloudEventsDatastoreLogBatch(t *testing.T) {
+	store := &recordingStore{}
+	ce := NewCloudEventsDatastore(store, CloudEventsStructured)
+
+	if err := ce.LogBatch([]interface{}{testHit(), testHit()}); err != nil {
+		t.Fatalf("LogBatch: %v", err)
+	}
+	if got := store.count(); got != 2 {
+		t.Fatalf("store recorded %d envelopes, want 2", got)
+	}
+}
+
+// nonHit isn't a *Hit, so ce.envelope should reject it rather than panic.
+type nonHit struct{}
+
+func TestCloudEventsDatastoreLogItRejectsNonHit(t *testing.T) {
+	store := &recordingStore{}
+	ce := NewCloudEventsDatastore(store, CloudEventsStructured)
+
+	err := ce.LogIt(nonHit{})
+	if err == nil {
+		t.Fatal("LogIt accepted a non-*Hit value")
+	}
+	var perm *PermanentError
+	if !errors.As(err, &perm) {
+		t.Fatalf("LogIt error = %v (%T), want a *PermanentError", err, err)
+	}
+	if store.count() != 0 {
+		t.Fatal("store recorded something for a value that should have been rejected")
+	}
+}
+
+func TestNewEventIDIsUnique(t *testing.T) {
+	if newEventID() == newEventID() {
+		t.Fatal("newEventID returned the same id twice in a row")
+	}
+}
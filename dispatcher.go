@@ -0,0 +1,300 @@
+package gocollectanalytics
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default CollectorConfig tunables, used for any field left at its zero
+// value.
+const (
+	DefaultPoolSize      = 4
+	DefaultQueueSize     = 1000
+	DefaultBatchSize     = 20
+	DefaultFlushInterval = time.Second
+
+	maxRetries  = 5
+	baseBackoff = 100 * time.Millisecond
+)
+
+// A CollectorConfig configures the worker pool a Collector uses to record
+// hits: how many workers run, how deep the backlog may grow before
+// CollectData starts dropping hits, and how those workers batch writes to
+// the Datastore. Any field left at its zero value is replaced with a
+// default by NewCollector.
+type CollectorConfig struct {
+	// PoolSize is the number of persistent worker goroutines.
+	PoolSize int
+	// QueueSize is the capacity of the buffered job channel feeding the
+	// workers. A hit received once the queue is full is dropped.
+	QueueSize int
+	// BatchSize is the number of hits a worker accumulates before flushing
+	// them to the Datastore in a single call.
+	BatchSize int
+	// FlushInterval is the longest a worker holds a partial batch before
+	// flushing it anyway.
+	FlushInterval time.Duration
+
+	// Enrichers run, in order, over every hit before it is queued for
+	// recording.
+	Enrichers []Enricher
+
+	// DeadLetter, if set, is called once per hit that failed every retry,
+	// or that failed with a PermanentError and so was not retried.
+	// It must not block; slow handling should hand off to its own
+	// goroutine or channel.
+	DeadLetter func(hit interface{}, err error)
+
+	// CloudEvents, if set, wraps the Collector's Datastore in a
+	// CloudEventsDatastore using this Mode, so every hit is recorded as a
+	// CloudEvents 1.0 envelope instead of a bare hit.
+	CloudEvents *CloudEventsOptions
+
+	// StrictProperties, when true, rejects hits whose custom properties
+	// don't match the PropertySchema registered for their tid via
+	// Collector.RegisterSchema.
+	StrictProperties bool
+}
+
+// CloudEventsOptions configures the CloudEventsDatastore a Collector wraps
+// its store in when CollectorConfig.CloudEvents is set.
+type CloudEventsOptions struct {
+	Mode CloudEventsMode
+}
+
+func (cfg CollectorConfig) withDefaults() CollectorConfig {
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = DefaultPoolSize
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultQueueSize
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultFlushInterval
+	}
+	return cfg
+}
+
+// Stats is a snapshot of a dispatcher's health, as returned by
+// Collector.Stats.
+type Stats struct {
+	// QueueDepth is the number of hits currently buffered, waiting for a
+	// worker.
+	QueueDepth int
+	// Dropped is the number of hits discarded because the queue was full
+	// or the dispatcher had already been shut down.
+	Dropped uint64
+	// Active is the number of workers currently flushing a batch.
+	Active int
+	// PoolSize is the configured number of workers.
+	PoolSize int
+}
+
+// A dispatcher owns the worker pool that turns queued hits into Datastore
+// writes. It replaces a naive "go coll.record(hit)" per-request goroutine
+// with a bounded queue, persistent workers, batched writes, retry with
+// backoff, and a dead-letter hook for hits that never make it.
+type dispatcher struct {
+	store Datastore
+	cfg   CollectorConfig
+
+	jobs chan interface{}
+
+	mu     sync.RWMutex
+	closed bool
+
+	wg      sync.WaitGroup
+	active  int32
+	dropped uint64
+}
+
+// newDispatcher starts cfg.PoolSize worker goroutines draining a queue of
+// capacity cfg.QueueSize.
+func newDispatcher(store Datastore, cfg CollectorConfig) *dispatcher {
+	d := &dispatcher{
+		store: store,
+		cfg:   cfg,
+		jobs:  make(chan interface{}, cfg.QueueSize),
+	}
+	for i := 0; i < cfg.PoolSize; i++ {
+		d.wg.Add(1)
+		go d.worker()
+	}
+	return d
+}
+
+// enqueue hands hit to a worker, dropping it if the queue is full or the
+// dispatcher has been shut down, so that a slow Datastore applies
+// backpressure instead of unbounded memory growth.
+func (d *dispatcher) enqueue(hit interface{}) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		atomic.AddUint64(&d.dropped, 1)
+		return
+	}
+
+	select {
+	case d.jobs <- hit:
+	default:
+		atomic.AddUint64(&d.dropped, 1)
+		log.Print("dispatcher queue full, dropping hit")
+	}
+}
+
+// worker accumulates hits into a batch, flushing it once it reaches
+// cfg.BatchSize or cfg.FlushInterval elapses, whichever comes first. When
+// jobs is closed it flushes whatever remains before returning, so a
+// Shutdown drains in-flight hits rather than discarding them.
+func (d *dispatcher) worker() {
+	defer d.wg.Done()
+
+	batch := make([]interface{}, 0, d.cfg.BatchSize)
+	ticker := time.NewTicker(d.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		atomic.AddInt32(&d.active, 1)
+		d.flushBatch(batch)
+		atomic.AddInt32(&d.active, -1)
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case hit, ok := <-d.jobs:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, hit)
+			if len(batch) >= d.cfg.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// flushBatch writes batch to the store, using a single LogBatch call when
+// the store supports it and falling back to one LogIt call per hit
+// otherwise. Each write is retried with exponential backoff before being
+// handed to the dead-letter hook.
+func (d *dispatcher) flushBatch(batch []interface{}) {
+	if bds, ok := d.store.(BatchDatastore); ok {
+		if err := d.retry(func() error { return bds.LogBatch(batch) }); err != nil {
+			d.deadLetter(batch, err)
+		}
+		return
+	}
+
+	for _, hit := range batch {
+		hit := hit
+		if err := d.retry(func() error { return d.store.LogIt(hit) }); err != nil {
+			d.deadLetter([]interface{}{hit}, err)
+		}
+	}
+}
+
+// A PermanentError marks a Datastore error as not worth retrying: the same
+// input will fail the same way no matter how many times fn runs, so retry
+// dead-letters it immediately instead of burning maxRetries attempts and a
+// worker's time on exponential backoff. Wrap an error with
+// NewPermanentError in a Datastore's LogIt or LogBatch to signal this, e.g. for a hit that fails to marshal rather than one a sink
+// was momentarily unreachable for.
+type PermanentError struct {
+	Err error
+}
+
+// NewPermanentError wraps err as a PermanentError.
+func NewPermanentError(err error) *PermanentError {
+	return &PermanentError{Err: err}
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+
+// Unwrap supports errors.Is/errors.As against the wrapped error.
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// retry calls fn until it succeeds, fn returns a PermanentError, or
+// maxRetries is exceeded, doubling its backoff after each failure. A
+// PermanentError is returned immediately, without consuming the remaining
+// retries or sleeping.
+func (d *dispatcher) retry(fn func() error) error {
+	var err error
+	backoff := baseBackoff
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		var perm *PermanentError
+		if errors.As(err, &perm) {
+			return err
+		}
+		if attempt == maxRetries {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return err
+}
+
+// deadLetter reports hits that failed every retry attempt, or failed with a
+// PermanentError, via cfg's hook
+// if one was supplied, or the standard logger otherwise.
+func (d *dispatcher) deadLetter(hits []interface{}, err error) {
+	if d.cfg.DeadLetter == nil {
+		log.Printf("dispatcher: dropping %d hit(s) after retries exhausted: %v", len(hits), err)
+		return
+	}
+	for _, hit := range hits {
+		d.cfg.DeadLetter(hit, err)
+	}
+}
+
+// stats returns a snapshot of the dispatcher's current health.
+func (d *dispatcher) stats() Stats {
+	return Stats{
+		QueueDepth: len(d.jobs),
+		Dropped:    atomic.LoadUint64(&d.dropped),
+		Active:     int(atomic.LoadInt32(&d.active)),
+		PoolSize:   d.cfg.PoolSize,
+	}
+}
+
+// close stops the dispatcher from accepting new hits and waits for workers
+// to drain the queue and flush, or for ctx to be done, whichever happens
+// first.
+func (d *dispatcher) close(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.jobs)
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,107 @@
+package gocollectanalytics
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDispatcherConcurrentEnqueueAndShutdownDrains(t *testing.T) {
+	store := &recordingStore{}
+	d := newDispatcher(store, CollectorConfig{
+		PoolSize:      4,
+		QueueSize:     1000,
+		BatchSize:     10,
+		FlushInterval: 5 * time.Millisecond,
+	}.withDefaults())
+
+	const n = 500
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			d.enqueue(i)
+		}(i)
+	}
+	wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := d.close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	if got := store.count(); got != n {
+		t.Fatalf("store recorded %d hits, want %d", got, n)
+	}
+}
+
+func TestDispatcherEnqueueDropsWhenClosed(t *testing.T) {
+	store := &recordingStore{}
+	d := newDispatcher(store, CollectorConfig{}.withDefaults())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := d.close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	d.enqueue("too late")
+	if got := d.stats().Dropped; got != 1 {
+		t.Fatalf("Dropped = %d, want 1", got)
+	}
+}
+
+// failingStore always fails, wrapping its error as permanent or not
+// depending on permanent.
+type failingStore struct {
+	mu        sync.Mutex
+	attempts  int
+	permanent bool
+}
+
+func (s *failingStore) LogIt(interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts++
+	err := errors.New("store unavailable")
+	if s.permanent {
+		return NewPermanentError(err)
+	}
+	return err
+}
+
+func (s *failingStore) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts
+}
+
+func TestRetryStopsImmediatelyOnPermanentError(t *testing.T) {
+	store := &failingStore{permanent: true}
+	d := &dispatcher{store: store, cfg: CollectorConfig{}.withDefaults()}
+
+	err := d.retry(func() error { return store.LogIt(nil) })
+	if err == nil {
+		t.Fatal("retry returned nil for a permanently failing fn")
+	}
+	if got := store.count(); got != 1 {
+		t.Fatalf("fn was called %d times, want 1 (no retries for a PermanentError)", got)
+	}
+}
+
+func TestRetryExhaustsAttemptsOnTransientError(t *testing.T) {
+	store := &failingStore{}
+	d := &dispatcher{store: store, cfg: CollectorConfig{}.withDefaults()}
+
+	err := d.retry(func() error { return store.LogIt(nil) })
+	if err == nil {
+		t.Fatal("retry returned nil for an always-failing fn")
+	}
+	if got := store.count(); got != maxRetries+1 {
+		t.Fatalf("fn was called %d times, want %d", got, maxRetries+1)
+	}
+}
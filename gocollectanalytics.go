@@ -5,16 +5,29 @@ Google Analytics -style styntax and save it in the desired datastore
 package gocollectanalytics
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // A Collector provides handling for receiving data and recording it to
 // the given store
 type Collector struct {
-	store Datastore
+	enrichers []Enricher
+	dispatch  *dispatcher
+	stream    *streamHub
+
+	strictProperties bool
+	schemaMu         sync.RWMutex
+	schemas          map[string]PropertySchema
 }
 
 // A Datastore is any place to store data. It must satisfy this interface,
@@ -23,63 +36,640 @@ type Datastore interface {
 	LogIt(interface{}) error
 }
 
-// NewCollector constructs a Collector with the specified type of store
-func NewCollector(ds Datastore) *Collector {
+// NewCollector constructs a Collector with the specified type of store,
+// configured by cfg. Received hits are run through cfg.Enrichers and then
+// handed to a dispatcher worker pool for recording, rather than being
+// written synchronously.
+func NewCollector(ds Datastore, cfg CollectorConfig) *Collector {
+	cfg = cfg.withDefaults()
+	if cfg.CloudEvents != nil {
+		ds = NewCloudEventsDatastore(ds, cfg.CloudEvents.Mode)
+	}
 	return &Collector{
-		store: ds,
+		enrichers:        cfg.Enrichers,
+		dispatch:         newDispatcher(ds, cfg),
+		stream:           newStreamHub(),
+		strictProperties: cfg.StrictProperties,
+		schemas:          map[string]PropertySchema{},
 	}
 }
 
+// A Hit is a single decoded Measurement Protocol hit, together with
+// whatever additional context the Collector's Enrichers derived from the
+// HTTP request that delivered it (geography, device, locale, referrer...).
+type Hit struct {
+	HitType `json:"hit"`
+
+	// ReceivedAt is when the Collector decoded this hit.
+	ReceivedAt time.Time `json:"received_at"`
+
+	Country      string `json:"country,omitempty"`
+	City         string `json:"city,omitempty"`
+	DeviceType   string `json:"device_type,omitempty"`
+	OS           string `json:"os,omitempty"`
+	Browser      string `json:"browser,omitempty"`
+	Locale       string `json:"locale,omitempty"`
+	ReferrerHost string `json:"referrer_host,omitempty"`
+	ReferrerPath string `json:"referrer_path,omitempty"`
+}
+
 // CollectData is a http.HandlerFunc to parse and validate querystring data
 // then save it as the appropriate type in the specified datastore.
 func (coll *Collector) CollectData(w http.ResponseWriter, r *http.Request) {
-	params := r.URL.Query()
-	dataValid, err := validateParameters(params)
-	if dataValid != true {
+	hit, err := coll.decodeHit(r.URL.Query(), r)
+	if err != nil {
 		log.Print(err)
 		w.WriteHeader(http.StatusBadRequest)
-	} else {
-		e := createEvent(params)
-		go coll.record(e) // naive concurrency: http://marcio.io/2015/07/handling-1-million-requests-per-minute-with-golang/
-		w.WriteHeader(http.StatusOK)
-		//fmt.Fprint(w, "collected ok")
+		return
 	}
+	coll.dispatch.enqueue(hit)
+	coll.stream.publish(hit)
+	w.WriteHeader(http.StatusOK)
+	//fmt.Fprint(w, "collected ok")
 }
 
-// wraps the recording function of the underlying store
-func (coll *Collector) record(datatype interface{}) string {
-	err := coll.store.LogIt(datatype)
-	if err != nil {
-		return "boo!"
+// Stats reports a snapshot of the dispatcher's health: queue depth, hits
+// dropped because the queue was full or the dispatcher was shut down, and
+// worker utilization.
+func (coll *Collector) Stats() Stats {
+	return coll.dispatch.stats()
+}
+
+// Shutdown stops the dispatcher from accepting new hits and waits for
+// queued and in-flight hits to be flushed to the Datastore, or for ctx to
+// be done, whichever happens first.
+func (coll *Collector) Shutdown(ctx context.Context) error {
+	return coll.dispatch.close(ctx)
+}
+
+// decodeHit validates vals against the Measurement Protocol spec, decodes
+// it into its typed HitType, and runs it through coll's Enricher chain.
+func (coll *Collector) decodeHit(vals url.Values, r *http.Request) (*Hit, error) {
+	hitType, errs := validateParameters(vals)
+	if errs != nil {
+		return nil, errs
+	}
+
+	hit := &Hit{HitType: hitType, ReceivedAt: time.Now()}
+
+	if err := coll.validateSchema(hit); err != nil {
+		return nil, err
 	}
-	return "ok"
+
+	for _, e := range coll.enrichers {
+		if err := e.Enrich(r.Context(), hit, r); err != nil {
+			log.Print(err)
+		}
+	}
+	return hit, nil
+}
+
+// A HitType is a single parsed and validated Measurement Protocol hit, ready
+// to be handed to a Datastore. Every hit type (event, pageview, ...)
+// implements this interface so the Collector can treat them uniformly.
+type HitType interface {
+	// HitName returns the Measurement Protocol 't' value this hit was
+	// decoded from, e.g. "event" or "pageview".
+	HitName() string
+}
+
+// hitDecoder parses and validates the hit-specific fields of a Measurement
+// Protocol payload, returning the typed HitType for it.
+type hitDecoder func(url.Values) (HitType, error)
+
+// hitTypes holds the registered decoder for every supported 't' value.
+var hitTypes = map[string]hitDecoder{}
+
+// RegisterHitType makes a hit type available under the given Measurement
+// Protocol 't' value, so that validateParameters and CollectData know how to
+// decode and validate it. Call it from an init() to add support for a hit
+// type, whether built into this package or supplied by a caller.
+func RegisterHitType(name string, decoder func(url.Values) (HitType, error)) {
+	hitTypes[name] = decoder
+}
+
+func init() {
+	RegisterHitType("pageview", decodePageview)
+	RegisterHitType("screenview", decodeScreenview)
+	RegisterHitType("event", decodeEvent)
+	RegisterHitType("transaction", decodeTransaction)
+	RegisterHitType("item", decodeItem)
+	RegisterHitType("social", decodeSocial)
+	RegisterHitType("exception", decodeException)
+	RegisterHitType("timing", decodeTiming)
+}
+
+// multipleErrors are a slice of Errors
+type multipleErrors []error
+
+// Common holds the Measurement Protocol fields shared by every hit type:
+// user/client identification, session control, campaign attribution,
+// document info, and custom dimensions/metrics.
+type Common struct {
+	Site     string `json:"tid"`
+	ClientID string `json:"cid,omitempty"`
+	UserID   string `json:"uid,omitempty"`
+
+	// SessionControl is "start" or "end" to force-start or force-end a
+	// session, or "" to let the session continue as normal.
+	SessionControl string `json:"sc,omitempty"`
+
+	CampaignName    string `json:"cn,omitempty"`
+	CampaignSource  string `json:"cs,omitempty"`
+	CampaignMedium  string `json:"cm,omitempty"`
+	CampaignKeyword string `json:"ck,omitempty"`
+	CampaignContent string `json:"cc,omitempty"`
+
+	DocLocation string `json:"dl,omitempty"`
+	DocHostname string `json:"dh,omitempty"`
+	DocPath     string `json:"dp,omitempty"`
+	DocTitle    string `json:"dt,omitempty"`
+	DocReferrer string `json:"dr,omitempty"`
+
+	// CustomDimensions and CustomMetrics hold the cd<N>/cm<N> parameters,
+	// keyed by their index N.
+	CustomDimensions map[int]string  `json:"custom_dimensions,omitempty"`
+	CustomMetrics    map[int]float64 `json:"custom_metrics,omitempty"`
+
+	// Properties holds any non-reserved query parameter as a
+	// JSON-compatible scalar (string, float64 or bool), for custom
+	// dimensions that don't need the numbered cd<N>/cm<N> slots. See
+	// Collector.RegisterSchema to validate these against a declared shape.
+	Properties map[string]interface{} `json:"properties,omitempty"`
+}
+
+// SiteID returns the Measurement Protocol tid this hit belongs to.
+func (c Common) SiteID() string { return c.Site }
+
+// PropertyValues returns the custom properties parsed for this hit.
+func (c Common) PropertyValues() map[string]interface{} { return c.Properties }
+
+// parseCommon extracts the fields shared by all hit types out of vals,
+// collecting any errors rather than stopping at the first one.
+func parseCommon(vals url.Values) (Common, multipleErrors) {
+	errs := multipleErrors{}
+
+	c := Common{
+		Site:            vals.Get("tid"),
+		ClientID:        vals.Get("cid"),
+		UserID:          vals.Get("uid"),
+		SessionControl:  vals.Get("sc"),
+		CampaignName:    vals.Get("cn"),
+		CampaignSource:  vals.Get("cs"),
+		CampaignMedium:  vals.Get("cm"),
+		CampaignKeyword: vals.Get("ck"),
+		CampaignContent: vals.Get("cc"),
+		DocLocation:     vals.Get("dl"),
+		DocHostname:     vals.Get("dh"),
+		DocPath:         vals.Get("dp"),
+		DocTitle:        vals.Get("dt"),
+		DocReferrer:     vals.Get("dr"),
+	}
+
+	if c.SessionControl != "" && c.SessionControl != "start" && c.SessionControl != "end" {
+		errs = append(errs, errors.New("Session control sc must be 'start' or 'end'"))
+	}
+
+	dims, metrics, dimErrs := parseCustomDimensionsAndMetrics(vals)
+	c.CustomDimensions = dims
+	c.CustomMetrics = metrics
+	errs = append(errs, dimErrs...)
+
+	props, propErrs := parseProperties(vals)
+	c.Properties = props
+	errs = append(errs, propErrs...)
+
+	return c, errs
+}
+
+// customIndex reports whether key is of the form prefix+N for a positive
+// integer N (e.g. "cd3" under prefix "cd"), as used by both custom
+// dimensions (cd<N>) and custom metrics (cm<N>).
+func customIndex(key, prefix string) (int, bool) {
+	if !strings.HasPrefix(key, prefix) || key == prefix {
+		return 0, false
+	}
+	n, err := strconv.Atoi(key[len(prefix):])
+	if err != nil || n < 1 {
+		return 0, false
+	}
+	return n, true
+}
+
+// parseCustomDimensionsAndMetrics picks out the cd<N> and cm<N> parameters
+// and decodes their index and value, collecting any malformed entries.
+func parseCustomDimensionsAndMetrics(vals url.Values) (map[int]string, map[int]float64, multipleErrors) {
+	errs := multipleErrors{}
+	dims := map[int]string{}
+	metrics := map[int]float64{}
+
+	for key, vs := range vals {
+		if len(vs) == 0 {
+			continue
+		}
+		if n, ok := customIndex(key, "cd"); ok {
+			dims[n] = vs[0]
+			continue
+		}
+		// cm<N> (custom metric N) overlaps textually with the bare "cm"
+		// campaign medium parameter; anything that doesn't parse as an
+		// index is simply not a custom metric and is ignored here.
+		if n, ok := customIndex(key, "cm"); ok {
+			f, err := strconv.ParseFloat(vs[0], 64)
+			if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+				errs = append(errs, fmt.Errorf("Custom metric %q must be a finite number", key))
+				continue
+			}
+			metrics[n] = f
+		}
+	}
+
+	return dims, metrics, errs
+}
+
+// reservedParams are the Measurement Protocol parameter names already
+// handled elsewhere (general, Common, or one of the hit-specific
+// decoders). Anything else becomes a custom Property.
+var reservedParams = map[string]bool{
+	"v": true, "tid": true, "t": true,
+	"cid": true, "uid": true, "sc": true,
+	"cn": true, "cs": true, "cm": true, "ck": true, "cc": true,
+	"dl": true, "dh": true, "dp": true, "dt": true, "dr": true,
+	"cd": true,
+	"ec": true, "ea": true, "el": true, "ev": true,
+	"ti": true, "tr": true, "ts": true, "tt": true, "cu": true,
+	"in": true, "ip": true, "iq": true, "ic": true, "iv": true,
+	"sn": true, "sa": true, "st": true,
+	"exd": true, "exf": true,
+	"utc": true, "utv": true, "utt": true, "utl": true,
+}
+
+// parseProperties picks out every non-reserved query parameter as a custom
+// Property. A property's value must be a single JSON-compatible scalar:
+// a number, a boolean literal, or a plain string; arrays, objects, null and
+// multi-valued parameters are rejected.
+func parseProperties(vals url.Values) (map[string]interface{}, multipleErrors) {
+	errs := multipleErrors{}
+	props := map[string]interface{}{}
+
+	for key, vs := range vals {
+		if reservedParams[key] {
+			continue
+		}
+		if _, ok := customIndex(key, "cd"); ok {
+			continue
+		}
+		if _, ok := customIndex(key, "cm"); ok {
+			continue
+		}
+		if len(vs) != 1 {
+			errs = append(errs, fmt.Errorf("property %q must have a single value", key))
+			continue
+		}
+
+		v, err := parsePropertyValue(vs[0])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("property %q: %s", key, err))
+			continue
+		}
+		props[key] = v
+	}
+
+	if len(props) == 0 {
+		return nil, errs
+	}
+	return props, errs
+}
+
+// parsePropertyValue interprets a raw query parameter value as the scalar
+// it looks like: "true"/"false" as bool, a number as float64, otherwise a
+// plain string. "null", anything that looks like a JSON array or object, and
+// NaN/+-Inf (valid floats that can't survive a json.Marshal round trip) are
+// rejected, since Properties only holds JSON-safe scalars.
+func parsePropertyValue(s string) (interface{}, error) {
+	switch s {
+	case "null":
+		return nil, errors.New("null is not a supported property value")
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	if strings.HasPrefix(s, "[") || strings.HasPrefix(s, "{") {
+		return nil, errors.New("arrays and objects are not supported property values")
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, errors.New("NaN and Infinity are not supported property values")
+		}
+		return f, nil
+	}
+	return s, nil
 }
 
 // An Event is a user interactions with content that can be tracked independently
 // from a web page or a screen load. A simple example would be clicking a link.
 type Event struct {
-	Site     string `json:"site"`
-	ClientID string `json:"clientid"`
+	Common
 	Category string `json:"category"`
 	Action   string `json:"action"`
-	Label    string `json:"label"`
-	Value    int    `json:"value"`
+	Label    string `json:"label,omitempty"`
+	Value    int    `json:"value,omitempty"`
 }
 
-// mulitpleErrors are a slice of Errors
-type multipleErrors []error
+// HitName identifies Event as the Measurement Protocol "event" hit type.
+func (Event) HitName() string { return "event" }
+
+// decodeEvent turns the data parameters associated with a hit type of
+// 'event' into an Event, validating the fields particular to events.
+func decodeEvent(vals url.Values) (HitType, error) {
+	common, errs := parseCommon(vals)
+	e := Event{Common: common, Category: vals.Get("ec"), Action: vals.Get("ea"), Label: vals.Get("el")}
+
+	if e.Category == "" {
+		errs = append(errs, errors.New("Events must have a category"))
+	}
+	if e.Action == "" {
+		errs = append(errs, errors.New("Events must have an action"))
+	}
+	if ev := vals.Get("ev"); ev != "" {
+		v, err := strconv.Atoi(ev)
+		if err != nil {
+			errs = append(errs, errors.New("Event value ev must be an integer"))
+		} else {
+			e.Value = v
+		}
+	}
+
+	if len(errs) > 0 {
+		return e, errs
+	}
+	return e, nil
+}
+
+// A Pageview is the loading of a web page.
+type Pageview struct {
+	Common
+}
+
+// HitName identifies Pageview as the Measurement Protocol "pageview" hit type.
+func (Pageview) HitName() string { return "pageview" }
+
+// decodePageview decodes a hit type of 'pageview', which must identify the
+// page either by a full URL (dl) or by a hostname/path pair (dh/dp).
+func decodePageview(vals url.Values) (HitType, error) {
+	common, errs := parseCommon(vals)
+	p := Pageview{Common: common}
+
+	if p.DocLocation == "" && (p.DocHostname == "" || p.DocPath == "") {
+		errs = append(errs, errors.New("Pageviews must have a document location dl, or a hostname dh and path dp"))
+	}
 
-// createEvent turns the data paramaters associated with a hit type of 'event'
-// into a golang type Event
-func createEvent(data url.Values) Event {
-	e := Event{Site: data.Get("tid"), Category: data.Get("ec"), Action: data.Get("ea"), Label: data.Get("el")}
-	//skipping value and client id for now
-	return e
+	if len(errs) > 0 {
+		return p, errs
+	}
+	return p, nil
+}
+
+// A Screenview is the loading of a screen in a mobile or desktop application.
+type Screenview struct {
+	Common
+	ScreenName string `json:"screen_name"`
+}
+
+// HitName identifies Screenview as the Measurement Protocol "screenview" hit type.
+func (Screenview) HitName() string { return "screenview" }
+
+// decodeScreenview decodes a hit type of 'screenview'. Per the Measurement
+// Protocol, the screen name is carried in the bare 'cd' parameter, which is
+// distinct from the indexed 'cd<N>' custom dimensions.
+func decodeScreenview(vals url.Values) (HitType, error) {
+	common, errs := parseCommon(vals)
+	s := Screenview{Common: common, ScreenName: vals.Get("cd")}
+
+	if s.ScreenName == "" {
+		errs = append(errs, errors.New("Screenviews must have a screen name cd"))
+	}
+
+	if len(errs) > 0 {
+		return s, errs
+	}
+	return s, nil
+}
+
+// A Transaction is a completed ecommerce purchase.
+type Transaction struct {
+	Common
+	TransactionID string  `json:"transaction_id"`
+	Revenue       float64 `json:"revenue,omitempty"`
+	Shipping      float64 `json:"shipping,omitempty"`
+	Tax           float64 `json:"tax,omitempty"`
+	Currency      string  `json:"currency,omitempty"`
+}
+
+// HitName identifies Transaction as the Measurement Protocol "transaction" hit type.
+func (Transaction) HitName() string { return "transaction" }
+
+// decodeTransaction decodes a hit type of 'transaction'.
+func decodeTransaction(vals url.Values) (HitType, error) {
+	common, errs := parseCommon(vals)
+	t := Transaction{Common: common, TransactionID: vals.Get("ti"), Currency: vals.Get("cu")}
+
+	if t.TransactionID == "" {
+		errs = append(errs, errors.New("Transactions must have a transaction id ti"))
+	}
+
+	var err error
+	if t.Revenue, err = parseOptionalFloat(vals, "tr"); err != nil {
+		errs = append(errs, err)
+	}
+	if t.Shipping, err = parseOptionalFloat(vals, "ts"); err != nil {
+		errs = append(errs, err)
+	}
+	if t.Tax, err = parseOptionalFloat(vals, "tt"); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return t, errs
+	}
+	return t, nil
+}
+
+// An Item is a single line item within a Transaction.
+type Item struct {
+	Common
+	TransactionID string  `json:"transaction_id"`
+	Name          string  `json:"name"`
+	Price         float64 `json:"price,omitempty"`
+	Quantity      int     `json:"quantity,omitempty"`
+	Code          string  `json:"code,omitempty"`
+	Category      string  `json:"category,omitempty"`
+	Currency      string  `json:"currency,omitempty"`
+}
+
+// HitName identifies Item as the Measurement Protocol "item" hit type.
+func (Item) HitName() string { return "item" }
+
+// decodeItem decodes a hit type of 'item'.
+func decodeItem(vals url.Values) (HitType, error) {
+	common, errs := parseCommon(vals)
+	i := Item{
+		Common:        common,
+		TransactionID: vals.Get("ti"),
+		Name:          vals.Get("in"),
+		Code:          vals.Get("ic"),
+		Category:      vals.Get("iv"),
+		Currency:      vals.Get("cu"),
+	}
+
+	if i.TransactionID == "" {
+		errs = append(errs, errors.New("Items must have a transaction id ti"))
+	}
+	if i.Name == "" {
+		errs = append(errs, errors.New("Items must have a name in"))
+	}
+
+	var err error
+	if i.Price, err = parseOptionalFloat(vals, "ip"); err != nil {
+		errs = append(errs, err)
+	}
+	if iq := vals.Get("iq"); iq != "" {
+		if i.Quantity, err = strconv.Atoi(iq); err != nil {
+			errs = append(errs, errors.New("Item quantity iq must be an integer"))
+		}
+	}
+
+	if len(errs) > 0 {
+		return i, errs
+	}
+	return i, nil
 }
 
-// validateParameters takes a set of url.Values and parses them to ensure they
-// match the required data specification.
-func validateParameters(vals url.Values) (bool, multipleErrors) {
+// A Social is a social network interaction, such as a like or a share.
+type Social struct {
+	Common
+	Network string `json:"network"`
+	Action  string `json:"action"`
+	Target  string `json:"target,omitempty"`
+}
+
+// HitName identifies Social as the Measurement Protocol "social" hit type.
+func (Social) HitName() string { return "social" }
+
+// decodeSocial decodes a hit type of 'social'.
+func decodeSocial(vals url.Values) (HitType, error) {
+	common, errs := parseCommon(vals)
+	s := Social{Common: common, Network: vals.Get("sn"), Action: vals.Get("sa"), Target: vals.Get("st")}
+
+	if s.Network == "" {
+		errs = append(errs, errors.New("Social hits must have a network sn"))
+	}
+	if s.Action == "" {
+		errs = append(errs, errors.New("Social hits must have an action sa"))
+	}
+
+	if len(errs) > 0 {
+		return s, errs
+	}
+	return s, nil
+}
+
+// An Exception is a client-side error report.
+type Exception struct {
+	Common
+	Description string `json:"description,omitempty"`
+	Fatal       bool   `json:"fatal"`
+}
+
+// HitName identifies Exception as the Measurement Protocol "exception" hit type.
+func (Exception) HitName() string { return "exception" }
+
+// decodeException decodes a hit type of 'exception'. Per the Measurement
+// Protocol, exceptions are assumed fatal unless exf is explicitly '0'.
+func decodeException(vals url.Values) (HitType, error) {
+	common, errs := parseCommon(vals)
+	e := Exception{Common: common, Description: vals.Get("exd"), Fatal: true}
+
+	if exf := vals.Get("exf"); exf != "" {
+		switch exf {
+		case "0":
+			e.Fatal = false
+		case "1":
+			e.Fatal = true
+		default:
+			errs = append(errs, errors.New("Exception fatal flag exf must be '0' or '1'"))
+		}
+	}
+
+	if len(errs) > 0 {
+		return e, errs
+	}
+	return e, nil
+}
+
+// A Timing is a measurement of how long some user or application event took.
+type Timing struct {
+	Common
+	Category string `json:"category"`
+	Variable string `json:"variable"`
+	Time     int    `json:"time"`
+	Label    string `json:"label,omitempty"`
+}
+
+// HitName identifies Timing as the Measurement Protocol "timing" hit type.
+func (Timing) HitName() string { return "timing" }
+
+// decodeTiming decodes a hit type of 'timing'.
+func decodeTiming(vals url.Values) (HitType, error) {
+	common, errs := parseCommon(vals)
+	t := Timing{Common: common, Category: vals.Get("utc"), Variable: vals.Get("utv"), Label: vals.Get("utl")}
+
+	if t.Category == "" {
+		errs = append(errs, errors.New("Timing hits must have a category utc"))
+	}
+	if t.Variable == "" {
+		errs = append(errs, errors.New("Timing hits must have a variable name utv"))
+	}
+
+	utt := vals.Get("utt")
+	if utt == "" {
+		errs = append(errs, errors.New("Timing hits must have a time utt"))
+	} else if v, err := strconv.Atoi(utt); err != nil {
+		errs = append(errs, errors.New("Timing utt must be an integer number of milliseconds"))
+	} else {
+		t.Time = v
+	}
+
+	if len(errs) > 0 {
+		return t, errs
+	}
+	return t, nil
+}
+
+// parseOptionalFloat returns the value of key as a float64, or 0 if the
+// parameter is absent. It reports an error if the parameter is present but
+// not a finite number: NaN and +/-Inf are rejected, since they can't survive
+// a round trip through json.Marshal.
+func parseOptionalFloat(vals url.Values, key string) (float64, error) {
+	v := vals.Get(key)
+	if v == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("%s must be a finite number", key)
+	}
+	return f, nil
+}
+
+// validateParameters takes a set of url.Values, checks the general
+// Measurement Protocol parameters that apply to every hit type, and
+// dispatches to t's registered decoder for type-specific parsing and
+// validation. It decodes the hit exactly once: on success the returned
+// HitType is the same value decodeHit goes on to use, rather than being
+// discarded and re-parsed.
+func validateParameters(vals url.Values) (HitType, multipleErrors) {
 
 	errs := []error{}
 
@@ -93,30 +683,28 @@ func validateParameters(vals url.Values) (bool, multipleErrors) {
 		errs = append(errs, errors.New("Site id tid must be supplied"))
 	}
 
-	// NOT IMPLEMENTED - cid is the browser id of the client we are collecting data from
-	//if vals.Get("tid") == "" {
-	//  errs = append(errs, errors.New("Client id tid must be supplied"))
-	//}
-
-	// t is the type of hit. At present the only supported values is 'event'
-	if vals.Get("t") != "event" {
-		errs = append(errs, errors.New("Hit type 't' must be set, only type 'event' is currently supported"))
-	}
-
-	// events must have a category ec
-	if vals.Get("t") == "event" && vals.Get("ec") == "" {
-		errs = append(errs, errors.New("Events must have a category"))
+	// t is the type of hit. It is dispatched to its registered decoder for
+	// type-specific parsing and validation.
+	t := vals.Get("t")
+	decoder, ok := hitTypes[t]
+	if !ok {
+		errs = append(errs, fmt.Errorf("Hit type t %q is not supported", t))
+		return nil, errs
 	}
 
-	// events must have an action ea
-	if vals.Get("t") == "event" && vals.Get("ea") == "" {
-		errs = append(errs, errors.New("Events must have an action"))
+	hitType, err := decoder(vals)
+	if err != nil {
+		if me, ok := err.(multipleErrors); ok {
+			errs = append(errs, me...)
+		} else {
+			errs = append(errs, err)
+		}
 	}
 
 	if len(errs) > 0 {
-		return false, errs
+		return nil, errs
 	}
-	return true, nil
+	return hitType, nil
 
 }
 
@@ -0,0 +1,122 @@
+package gocollectanalytics
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestValidateParametersDecodesOnce(t *testing.T) {
+	vals := url.Values{
+		"v":   {"1"},
+		"tid": {"UA-12345-1"},
+		"t":   {"event"},
+		"ec":  {"video"},
+		"ea":  {"play"},
+	}
+
+	hitType, errs := validateParameters(vals)
+	if errs != nil {
+		t.Fatalf("validateParameters returned errors for a valid hit: %v", errs)
+	}
+	e, ok := hitType.(Event)
+	if !ok {
+		t.Fatalf("validateParameters returned %T, want Event", hitType)
+	}
+	if e.Category != "video" || e.Action != "play" {
+		t.Fatalf("decoded Event = %+v, want Category=video Action=play", e)
+	}
+}
+
+func TestValidateParametersRejectsUnknownHitType(t *testing.T) {
+	vals := url.Values{"v": {"1"}, "tid": {"UA-12345-1"}, "t": {"bogus"}}
+
+	hitType, errs := validateParameters(vals)
+	if errs == nil {
+		t.Fatal("validateParameters accepted an unsupported hit type")
+	}
+	if hitType != nil {
+		t.Fatalf("validateParameters returned a HitType alongside errors: %+v", hitType)
+	}
+}
+
+func TestValidateParametersRejectsMissingRequiredFields(t *testing.T) {
+	vals := url.Values{"v": {"1"}, "tid": {"UA-12345-1"}, "t": {"event"}}
+
+	if _, errs := validateParameters(vals); errs == nil {
+		t.Fatal("validateParameters accepted an event missing ec/ea")
+	}
+}
+
+func TestParseOptionalFloatRejectsNonFinite(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{"empty", "", false},
+		{"ordinary", "19.99", false},
+		{"nan", "NaN", true},
+		{"inf", "Inf", true},
+		{"negInf", "-Inf", true},
+		{"notNumeric", "abc", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vals := url.Values{}
+			if tt.value != "" {
+				vals.Set("tr", tt.value)
+			}
+			_, err := parseOptionalFloat(vals, "tr")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseOptionalFloat(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseCustomDimensionsAndMetricsRejectsNonFiniteMetric(t *testing.T) {
+	vals := url.Values{"cd1": {"blue"}, "cm1": {"Infinity"}}
+
+	dims, metrics, errs := parseCustomDimensionsAndMetrics(vals)
+	if len(errs) == 0 {
+		t.Fatal("parseCustomDimensionsAndMetrics accepted an infinite custom metric")
+	}
+	if dims[1] != "blue" {
+		t.Fatalf("dims[1] = %q, want \"blue\"", dims[1])
+	}
+	if _, ok := metrics[1]; ok {
+		t.Fatal("parseCustomDimensionsAndMetrics kept the rejected metric")
+	}
+}
+
+func TestParsePropertyValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    interface{}
+		wantErr bool
+	}{
+		{"bool true", "true", true, false},
+		{"bool false", "false", false, false},
+		{"number", "42.5", 42.5, false},
+		{"string", "hello", "hello", false},
+		{"null", "null", nil, true},
+		{"array", "[1,2]", nil, true},
+		{"object", `{"a":1}`, nil, true},
+		{"nan", "NaN", nil, true},
+		{"inf", "Inf", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePropertyValue(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePropertyValue(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Fatalf("parsePropertyValue(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package gocollectanalytics
+
+import "fmt"
+
+// A PropertyType is the JSON-compatible scalar type a custom Property must
+// have to satisfy a PropertySchema.
+type PropertyType int
+
+// The property types a PropertySchema can require.
+const (
+	PropertyString PropertyType = iota
+	PropertyNumber
+	PropertyBool
+)
+
+func (t PropertyType) String() string {
+	switch t {
+	case PropertyString:
+		return "string"
+	case PropertyNumber:
+		return "number"
+	case PropertyBool:
+		return "bool"
+	default:
+		return "unknown"
+	}
+}
+
+func (t PropertyType) matches(v interface{}) bool {
+	switch t {
+	case PropertyString:
+		_, ok := v.(string)
+		return ok
+	case PropertyNumber:
+		_, ok := v.(float64)
+		return ok
+	case PropertyBool:
+		_, ok := v.(bool)
+		return ok
+	default:
+		return false
+	}
+}
+
+// A PropertyField declares one expected custom property: the type its
+// value must have, and which hit types require it.
+type PropertyField struct {
+	Type PropertyType
+	// RequiredFor lists the hit type names (e.g. "event", "pageview") that
+	// must supply this property. Leave nil if it's always optional.
+	RequiredFor []string
+}
+
+func (f PropertyField) requiredFor(hitType string) bool {
+	for _, t := range f.RequiredFor {
+		if t == hitType {
+			return true
+		}
+	}
+	return false
+}
+
+// A PropertySchema declares the custom properties expected for a site's
+// hits: their names, types, and which hit types require them. Register one
+// per tid with Collector.RegisterSchema.
+type PropertySchema struct {
+	Properties map[string]PropertyField
+}
+
+// validate checks props, the custom properties parsed for a hit of the
+// given hitType, against s: every required property must be present and of
+// the declared type, and every supplied property must be declared.
+func (s PropertySchema) validate(hitType string, props map[string]interface{}) multipleErrors {
+	errs := multipleErrors{}
+
+	for name, field := range s.Properties {
+		v, present := props[name]
+		if !present {
+			if field.requiredFor(hitType) {
+				errs = append(errs, fmt.Errorf("property %q is required for hit type %q", name, hitType))
+			}
+			continue
+		}
+		if !field.Type.matches(v) {
+			errs = append(errs, fmt.Errorf("property %q must be of type %s", name, field.Type))
+		}
+	}
+
+	for name := range props {
+		if _, ok := s.Properties[name]; !ok {
+			errs = append(errs, fmt.Errorf("property %q is not declared in the schema", name))
+		}
+	}
+
+	return errs
+}
+
+// RegisterSchema declares the custom properties expected for site's hits.
+// When the Collector was constructed with StrictProperties enabled,
+// subsequent hits for that tid are validated against schema, and rejected
+// if they carry an undeclared or mistyped property, or are missing one the
+// schema marks required for their hit type.
+func (coll *Collector) RegisterSchema(site string, schema PropertySchema) {
+	coll.schemaMu.Lock()
+	defer coll.schemaMu.Unlock()
+	coll.schemas[site] = schema
+}
+
+// validateSchema enforces the schema registered for hit's tid, if
+// StrictProperties is enabled and one has been registered.
+func (coll *Collector) validateSchema(hit *Hit) error {
+	if !coll.strictProperties {
+		return nil
+	}
+
+	coll.schemaMu.RLock()
+	schema, ok := coll.schemas[siteID(hit)]
+	coll.schemaMu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	props := map[string]interface{}{}
+	if p, ok := hit.HitType.(interface{ PropertyValues() map[string]interface{} }); ok {
+		props = p.PropertyValues()
+	}
+
+	if errs := schema.validate(hit.HitName(), props); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package gocollectanalytics
+
+import (
+	"testing"
+)
+
+func TestPropertySchemaValidate(t *testing.T) {
+	schema := PropertySchema{Properties: map[string]PropertyField{
+		"plan":       {Type: PropertyString, RequiredFor: []string{"event"}},
+		"beta_user":  {Type: PropertyBool},
+		"cart_value": {Type: PropertyNumber, RequiredFor: []string{"transaction"}},
+	}}
+
+	tests := []struct {
+		name    string
+		hitType string
+		props   map[string]interface{}
+		wantErr bool
+	}{
+		{
+			name:    "satisfies required and typed fields",
+			hitType: "event",
+			props:   map[string]interface{}{"plan": "pro", "beta_user": true},
+		},
+		{
+			name:    "missing required for this hit type",
+			hitType: "event",
+			props:   map[string]interface{}{"beta_user": true},
+			wantErr: true,
+		},
+		{
+			name:    "not required for a different hit type",
+			hitType: "pageview",
+			props:   map[string]interface{}{},
+		},
+		{
+			name:    "wrong type",
+			hitType: "event",
+			props:   map[string]interface{}{"plan": "pro", "beta_user": "yes"},
+			wantErr: true,
+		},
+		{
+			name:    "undeclared property",
+			hitType: "event",
+			props:   map[string]interface{}{"plan": "pro", "extra": "nope"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := schema.validate(tt.hitType, tt.props)
+			if (len(errs) > 0) != tt.wantErr {
+				t.Fatalf("validate(%q, %v) errs = %v, wantErr %v", tt.hitType, tt.props, errs, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPropertyTypeMatches(t *testing.T) {
+	tests := []struct {
+		typ  PropertyType
+		val  interface{}
+		want bool
+	}{
+		{PropertyString, "x", true},
+		{PropertyString, 1.0, false},
+		{PropertyNumber, 1.0, true},
+		{PropertyNumber, "1", false},
+		{PropertyBool, true, true},
+		{PropertyBool, "true", false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.typ.matches(tt.val); got != tt.want {
+			t.Fatalf("%s.matches(%v) = %v, want %v", tt.typ, tt.val, got, tt.want)
+		}
+	}
+}
+
+func TestCollectorValidateSchemaEnforcesStrictMode(t *testing.T) {
+	store := &recordingStore{}
+	coll := NewCollector(store, CollectorConfig{StrictProperties: true})
+	coll.RegisterSchema("UA-12345-1", PropertySchema{Properties: map[string]PropertyField{
+		"plan": {Type: PropertyString, RequiredFor: []string{"event"}},
+	}})
+
+	missing := &Hit{HitType: Event{
+		Common:   Common{Site: "UA-12345-1"},
+		Category: "video",
+		Action:   "play",
+	}}
+	if err := coll.validateSchema(missing); err == nil {
+		t.Fatal("validateSchema accepted a hit missing its required property")
+	}
+
+	ok := &Hit{HitType: Event{
+		Common:   Common{Site: "UA-12345-1", Properties: map[string]interface{}{"plan": "pro"}},
+		Category: "video",
+		Action:   "play",
+	}}
+	if err := coll.validateSchema(ok); err != nil {
+		t.Fatalf("validateSchema rejected a hit satisfying its schema: %v", err)
+	}
+}
+
+func TestCollectorValidateSchemaSkipsWhenNotStrict(t *testing.T) {
+	store := &recordingStore{}
+	coll := NewCollector(store, CollectorConfig{})
+	coll.RegisterSchema("UA-12345-1", PropertySchema{Properties: map[string]PropertyField{
+		"plan": {Type: PropertyString, RequiredFor: []string{"event"}},
+	}})
+
+	hit := &Hit{HitType: Event{Common: Common{Site: "UA-12345-1"}, Category: "video", Action: "play"}}
+	if err := coll.validateSchema(hit); err != nil {
+		t.Fatalf("validateSchema enforced a schema with StrictProperties disabled: %v", err)
+	}
+}
+
+func TestCollectorValidateSchemaSkipsUnregisteredSite(t *testing.T) {
+	store := &recordingStore{}
+	coll := NewCollector(store, CollectorConfig{StrictProperties: true})
+
+	hit := &Hit{HitType: Event{Common: Common{Site: "UA-unregistered"}, Category: "video", Action: "play"}}
+	if err := coll.validateSchema(hit); err != nil {
+		t.Fatalf("validateSchema enforced a schema for a site with none registered: %v", err)
+	}
+}
@@ -0,0 +1,373 @@
+package gocollectanalytics
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocketGUID is the magic string RFC 6455 defines for computing the
+// Sec-WebSocket-Accept handshake response.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes this package understands.
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+)
+
+const (
+	// wsMaxFrameSize is the read limit: a frame claiming to be larger than
+	// this is treated as a protocol violation and the connection is closed.
+	wsMaxFrameSize = 64 * 1024
+	// wsPongWait is how long a client has to respond to a ping before its
+	// connection is considered dead.
+	wsPongWait = 60 * time.Second
+	// wsPingPeriod is how often the server pings an idle client; it must
+	// stay comfortably under wsPongWait.
+	wsPingPeriod = (wsPongWait * 9) / 10
+	wsWriteWait  = 10 * time.Second
+	// wsSendBuffer bounds each client's outbound queue. A client that
+	// can't keep up is dropped rather than allowed to block ingestion.
+	wsSendBuffer = 16
+)
+
+// wsFrame is a control-frame reply (pong, close) queued for a client
+// outside of the regular hit stream.
+type wsFrame struct {
+	op      byte
+	payload []byte
+}
+
+// A streamClient is one WebSocket connection subscribed to a Collector's
+// hit stream, with its own bounded send queue so a slow reader can't block
+// ingestion, and a server-side filter applied to every published hit.
+type streamClient struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+
+	send    chan []byte
+	control chan wsFrame
+	filter  url.Values
+}
+
+func (c *streamClient) writeFrame(op byte, payload []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if err := writeFrame(c.rw, op, payload); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+// writePump owns all writes to the client: published hits, periodic pings,
+// and queued control replies. It exits, closing the connection, as soon as
+// a write fails or the send channel is closed.
+func (c *streamClient) writePump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case data, ok := <-c.send:
+			if !ok {
+				c.writeFrame(wsOpClose, nil)
+				return
+			}
+			if err := c.writeFrame(wsOpText, data); err != nil {
+				return
+			}
+		case f := <-c.control:
+			if err := c.writeFrame(f.op, f.payload); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := c.writeFrame(wsOpPing, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readPump only expects control frames from the client (pings, pongs, and
+// close); this is a one-way tap, so any text or binary frame is ignored.
+// It returns, prompting the hub to drop the client, once the connection
+// errors, the read limit is exceeded, or the client closes.
+func (c *streamClient) readPump(hub *streamHub) {
+	defer hub.remove(c)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+
+	for {
+		op, payload, err := readFrame(c.rw)
+		if err != nil {
+			return
+		}
+		switch op {
+		case wsOpPong:
+			c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		case wsOpPing:
+			select {
+			case c.control <- wsFrame{op: wsOpPong, payload: payload}:
+			default:
+			}
+		case wsOpClose:
+			return
+		}
+	}
+}
+
+// A streamHub fans out validated hits to every connected streamClient whose
+// filter matches, dropping clients that can't keep up instead of blocking
+// ingestion on a slow reader.
+type streamHub struct {
+	mu      sync.Mutex
+	clients map[*streamClient]struct{}
+}
+
+func newStreamHub() *streamHub {
+	return &streamHub{clients: map[*streamClient]struct{}{}}
+}
+
+func (h *streamHub) add(c *streamClient) {
+	h.mu.Lock()
+	h.clients[c] = struct{}{}
+	h.mu.Unlock()
+}
+
+// clientCount reports how many clients are currently subscribed.
+func (h *streamHub) clientCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+func (h *streamHub) remove(c *streamClient) {
+	h.mu.Lock()
+	if _, ok := h.clients[c]; ok {
+		delete(h.clients, c)
+		close(c.send)
+	}
+	h.mu.Unlock()
+}
+
+// publish sends hit, JSON-encoded, to every client whose filter matches.
+// A client whose send queue is already full is dropped.
+func (h *streamHub) publish(hit *Hit) {
+	data, err := json.Marshal(hit)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var drop []*streamClient
+	for c := range h.clients {
+		if !matchesFilter(hit, c.filter) {
+			continue
+		}
+		select {
+		case c.send <- data:
+		default:
+			drop = append(drop, c)
+		}
+	}
+	for _, c := range drop {
+		delete(h.clients, c)
+		close(c.send)
+	}
+}
+
+// matchesFilter applies the tid/t/ec query parameters a StreamHandler
+// client connected with, server-side, so a client only receives the hits
+// it asked for.
+func matchesFilter(hit *Hit, filter url.Values) bool {
+	if tid := filter.Get("tid"); tid != "" && siteID(hit) != tid {
+		return false
+	}
+	if t := filter.Get("t"); t != "" && hit.HitName() != t {
+		return false
+	}
+	if ec := filter.Get("ec"); ec != "" {
+		e, ok := hit.HitType.(Event)
+		if !ok || e.Category != ec {
+			return false
+		}
+	}
+	return true
+}
+
+// StreamHandler is a http.HandlerFunc that upgrades the request to a
+// WebSocket and pushes every hit the Collector subsequently validates to the
+// client as a JSON frame, including hits the dispatcher then drops, filtered server-side by the request's query
+// parameters (tid, t, ec). It is independent of whatever Datastore the
+// Collector is configured with.
+func (coll *Collector) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	client, err := upgradeWebSocket(w, r)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	client.filter = r.URL.Query()
+
+	coll.stream.add(client)
+	go client.writePump()
+	client.readPump(coll.stream)
+}
+
+// upgradeWebSocket performs the RFC 6455 handshake over w/r and hijacks the
+// underlying connection, rejecting cross-origin upgrade attempts.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*streamClient, error) {
+	if !strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+		return nil, errors.New("websocket: missing Connection: Upgrade header")
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return nil, errors.New("websocket: missing Upgrade: websocket header")
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || !strings.EqualFold(u.Host, r.Host) {
+			return nil, errors.New("websocket: cross-origin upgrade rejected")
+		}
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("websocket: missing Sec-WebSocket-Key header")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("websocket: response writer does not support hijacking")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n"
+	if _, err := rw.WriteString(response); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &streamClient{
+		conn:    conn,
+		rw:      rw,
+		send:    make(chan []byte, wsSendBuffer),
+		control: make(chan wsFrame, 1),
+	}, nil
+}
+
+// websocketAccept computes the Sec-WebSocket-Accept value for key.
+func websocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// readFrame reads one WebSocket frame from r. Fragmented messages aren't
+// supported; each frame is treated as a complete message, which is
+// sufficient for the control frames and small client messages this tap
+// expects to receive.
+func readFrame(r io.Reader) (op byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	op = header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > wsMaxFrameSize {
+		return 0, nil, errors.New("websocket: frame exceeds read limit")
+	}
+
+	var maskKey [4]byte
+	if masked {
+		if _, err = io.ReadFull(r, maskKey[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= maskKey[i%4]
+		}
+	}
+	return op, payload, nil
+}
+
+// writeFrame writes payload to w as a single, unmasked WebSocket frame, as
+// RFC 6455 requires of server-to-client frames.
+func writeFrame(w io.Writer, op byte, payload []byte) error {
+	length := len(payload)
+	finAndOp := byte(0x80) | op
+
+	var header []byte
+	switch {
+	case length <= 125:
+		header = []byte{finAndOp, byte(length)}
+	case length <= 0xffff:
+		header = make([]byte, 4)
+		header[0] = finAndOp
+		header[1] = 126
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header = make([]byte, 10)
+		header[0] = finAndOp
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if length == 0 {
+		return nil
+	}
+	_, err := w.Write(payload)
+	return err
+}
@@ -0,0 +1,227 @@
+package gocollectanalytics
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebsocketAccept(t *testing.T) {
+	// The example handshake from RFC 6455 section 1.3.
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+	const want = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+
+	if got := websocketAccept(key); got != want {
+		t.Fatalf("websocketAccept(%q) = %q, want %q", key, got, want)
+	}
+}
+
+func TestWriteFrameReadFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		op   byte
+		size int
+	}{
+		{"empty", wsOpPing, 0},
+		{"small", wsOpText, 10},
+		{"extended16", wsOpText, 200},            // 126 path: length encoded in 2 extra bytes
+		{"extended64", wsOpText, wsMaxFrameSize}, // 127 path: length encoded in 8 extra bytes
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := bytes.Repeat([]byte("a"), tt.size)
+
+			var buf bytes.Buffer
+			if err := writeFrame(&buf, tt.op, payload); err != nil {
+				t.Fatalf("writeFrame: %v", err)
+			}
+
+			op, got, err := readFrame(&buf)
+			if err != nil {
+				t.Fatalf("readFrame: %v", err)
+			}
+			if op != tt.op {
+				t.Fatalf("op = %#x, want %#x", op, tt.op)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Fatalf("payload length = %d, want %d", len(got), len(payload))
+			}
+		})
+	}
+}
+
+// buildMaskedFrame constructs a masked client->server frame by hand, the way
+// a spec-compliant browser client would send one, to confirm readFrame
+// unmasks it correctly.
+func buildMaskedFrame(op byte, payload []byte, maskKey [4]byte) []byte {
+	masked := make([]byte, len(payload))
+	for i, b := range payload {
+		masked[i] = b ^ maskKey[i%4]
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(0x80 | op)
+	switch {
+	case len(payload) <= 125:
+		buf.WriteByte(0x80 | byte(len(payload)))
+	case len(payload) <= 0xffff:
+		buf.WriteByte(0x80 | 126)
+		binary.Write(&buf, binary.BigEndian, uint16(len(payload)))
+	default:
+		buf.WriteByte(0x80 | 127)
+		binary.Write(&buf, binary.BigEndian, uint64(len(payload)))
+	}
+	buf.Write(maskKey[:])
+	buf.Write(masked)
+	return buf.Bytes()
+}
+
+func TestReadFrameUnmasksClientFrames(t *testing.T) {
+	payload := []byte("hello from a browser")
+	maskKey := [4]byte{0x12, 0x34, 0x56, 0x78}
+
+	op, got, err := readFrame(bytes.NewReader(buildMaskedFrame(wsOpText, payload, maskKey)))
+	if err != nil {
+		t.Fatalf("readFrame: %v", err)
+	}
+	if op != wsOpText {
+		t.Fatalf("op = %#x, want %#x", op, wsOpText)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("readFrame unmasked = %q, want %q", got, payload)
+	}
+}
+
+func TestReadFrameRejectsOversizedFrame(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteByte(0x80 | wsOpText)
+	buf.WriteByte(127)
+	binary.Write(&buf, binary.BigEndian, uint64(wsMaxFrameSize+1))
+
+	if _, _, err := readFrame(&buf); err == nil {
+		t.Fatal("readFrame accepted a frame over wsMaxFrameSize")
+	}
+}
+
+// wsTestClient is a minimal, from-scratch WebSocket client used only to
+// drive StreamHandler end-to-end: it performs the RFC 6455 handshake and
+// then reads frames with the package's own readFrame.
+type wsTestClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialStream(t *testing.T, serverURL string) *wsTestClient {
+	t.Helper()
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatalf("net.Dial: %v", err)
+	}
+
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+	req := fmt.Sprintf(
+		"GET %s?%s HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nOrigin: http://%s\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n",
+		path, u.RawQuery, u.Host, u.Host, key,
+	)
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatalf("write handshake: %v", err)
+	}
+
+	r := bufio.NewReader(conn)
+	status, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("read status line: %v", err)
+	}
+	if !strings.Contains(status, "101") {
+		t.Fatalf("handshake status = %q, want 101", status)
+	}
+
+	var gotAccept string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read headers: %v", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if name, val, ok := strings.Cut(line, ": "); ok && strings.EqualFold(name, "Sec-WebSocket-Accept") {
+			gotAccept = val
+		}
+	}
+	if want := websocketAccept(key); gotAccept != want {
+		t.Fatalf("Sec-WebSocket-Accept = %q, want %q", gotAccept, want)
+	}
+
+	return &wsTestClient{conn: conn, r: r}
+}
+
+// readHit waits up to timeout for a text frame and returns its payload, or
+// ("", false) if none arrives in time.
+func (c *wsTestClient) readHit(timeout time.Duration) (string, bool) {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	op, payload, err := readFrame(c.r)
+	if err != nil {
+		return "", false
+	}
+	if op != wsOpText {
+		return "", false
+	}
+	return string(payload), true
+}
+
+func TestStreamHandlerPublishesMatchingHitsOnly(t *testing.T) {
+	store := &recordingStore{}
+	coll := NewCollector(store, CollectorConfig{})
+
+	server := httptest.NewServer(http.HandlerFunc(coll.StreamHandler))
+	defer server.Close()
+
+	client := dialStream(t, server.URL+"?tid=UA-12345-1&t=event&ec=video")
+	defer client.conn.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for coll.stream.clientCount() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the hub to register the client")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	nonMatching := &Hit{HitType: Event{Common: Common{Site: "UA-12345-1"}, Category: "audio", Action: "play"}}
+	coll.stream.publish(nonMatching)
+	if payload, ok := client.readHit(150 * time.Millisecond); ok {
+		t.Fatalf("client received a hit that should have been filtered out: %s", payload)
+	}
+
+	matching := &Hit{HitType: Event{Common: Common{Site: "UA-12345-1"}, Category: "video", Action: "play"}}
+	coll.stream.publish(matching)
+	payload, ok := client.readHit(time.Second)
+	if !ok {
+		t.Fatal("client never received the matching hit")
+	}
+	if !strings.Contains(payload, `"category":"video"`) {
+		t.Fatalf("payload = %s, want it to contain the matching hit's category", payload)
+	}
+}